@@ -0,0 +1,391 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	proxyconfig "istio.io/api/proxy/v1/config"
+)
+
+// EgressRulePriority carries the out-of-band tie-break data
+// RejectConflictingEgressRules needs to pick a deterministic winner.
+// EgressRule itself has no priority or creation-timestamp field, so a
+// caller that wants explicit control over which of two conflicting rules
+// wins must supply it here -- for example from the IdentityMapping-style
+// CRD wrapper's ObjectMeta.CreationTimestamp, or a future spec.priority
+// field, once EgressRule gains one.
+type EgressRulePriority struct {
+	// Priority wins over CreationTimestamp whenever it differs: higher
+	// Priority wins, mirroring an explicit operator-set priority field.
+	Priority int32
+	// CreationTimestamp is the k8s-convention fallback when two
+	// conflicting rules have equal (including both-unset) Priority: the
+	// earlier rule wins.
+	CreationTimestamp time.Time
+}
+
+// EgressRuleConflict describes why one EgressRule lost out to another:
+// both sit in the same group of overlapping hosts, and that group was
+// found conflicting (see conflictingGroup) rather than merged.
+type EgressRuleConflict struct {
+	// LosingRule and WinningRule are the map keys (rule names) passed to
+	// RejectConflictingEgressRules.
+	LosingRule, WinningRule string
+	// Host is LosingRule's declared host. Port and Protocol are the first
+	// port LosingRule shares with WinningRule, or LosingRule's first
+	// declared port if they share none (zero values if it declares none).
+	Host     string
+	Port     int32
+	Protocol string
+}
+
+func (c *EgressRuleConflict) Error() string {
+	return fmt.Sprintf("egress rule %q conflicts with %q on %s:%d/%s and was rejected",
+		c.LosingRule, c.WinningRule, c.Host, c.Port, c.Protocol)
+}
+
+// RejectConflictingEgressRules partitions rules into overlapping groups by
+// Destination.Service (treating "*host" and "*.host" wildcards as matching
+// any subdomain) and resolves each group in one of two ways:
+//
+//   - If the group's rules only disagree on which ports/protocols they
+//     cover (no two rules resolve to the same label path -- see
+//     conflictingGroup -- and no port number is claimed with two different
+//     protocols), they are complementary: they are merged into a single
+//     synthesized rule carrying the union of all ports, keyed under the
+//     name of the winning rule as picked below.
+//   - Otherwise the group has a real conflict (two rules resolve to the
+//     same label path -- whether an identical host or an exact host vs.
+//     its own wildcard, which is a disjoint sibling scope rather than a
+//     superset -- or some port is claimed with conflicting protocols). The
+//     winner is picked by rankRules: highest Priority in priorities wins,
+//     then earliest CreationTimestamp, then alphabetically first name as a
+//     last-resort, fully deterministic tie-break. Every other rule in the
+//     group is dropped and reported via an EgressRuleConflict.
+//
+// priorities supplies the out-of-band Priority/CreationTimestamp for rules
+// that have it; a rule absent from priorities (or passed a nil map)
+// competes as if both fields were zero, so the alphabetical tie-break
+// alone decides among rules for which no caller has an opinion.
+func RejectConflictingEgressRules(rules map[string]*proxyconfig.EgressRule, priorities map[string]EgressRulePriority) (map[string]*proxyconfig.EgressRule, []error) {
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := groupOverlappingRules(rules, names)
+
+	out := make(map[string]*proxyconfig.EgressRule)
+	var errs []error
+
+	for _, group := range groups {
+		rankRules(group, priorities)
+
+		if len(group) == 1 {
+			name := group[0]
+			out[name] = rules[name]
+			continue
+		}
+
+		if conflicting := conflictingGroup(rules, group); conflicting {
+			winner := group[0]
+			out[winner] = rules[winner]
+			for _, loser := range group[1:] {
+				errs = append(errs, conflictError(rules, loser, winner))
+			}
+			continue
+		}
+
+		winner, merged := mergeGroup(rules, group)
+		out[winner] = merged
+	}
+
+	return out, errs
+}
+
+// rankRules sorts group in place so that group[0] is the rule that should
+// win any conflict within the group: highest Priority first, then earliest
+// CreationTimestamp, then alphabetically first name. A name missing from
+// priorities sorts as though both fields were its zero value.
+func rankRules(group []string, priorities map[string]EgressRulePriority) {
+	sort.Slice(group, func(i, j int) bool {
+		pi, pj := priorities[group[i]], priorities[group[j]]
+		if pi.Priority != pj.Priority {
+			return pi.Priority > pj.Priority
+		}
+		if !pi.CreationTimestamp.Equal(pj.CreationTimestamp) {
+			return pi.CreationTimestamp.Before(pj.CreationTimestamp)
+		}
+		return group[i] < group[j]
+	})
+}
+
+// groupOverlappingRules partitions rule names into connected components
+// under the host-overlap relation (see hostTrie), using a deterministic
+// (sorted) iteration order so the grouping itself never depends on map
+// iteration order.
+func groupOverlappingRules(rules map[string]*proxyconfig.EgressRule, names []string) [][]string {
+	trie := newHostTrie()
+	for _, name := range names {
+		trie.insert(name, rules[name].Destination.GetService())
+	}
+
+	visited := make(map[string]bool, len(names))
+	var groups [][]string
+
+	for _, name := range names {
+		if visited[name] {
+			continue
+		}
+
+		// BFS over the overlap relation so transitive overlaps (e.g. A
+		// overlaps B via a wildcard, B overlaps C via a narrower one) land
+		// in the same group even if A and C don't overlap directly.
+		group := []string{}
+		queue := []string{name}
+		visited[name] = true
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			group = append(group, cur)
+			for _, other := range trie.overlapping(rules[cur].Destination.GetService(), cur) {
+				if !visited[other] {
+					visited[other] = true
+					queue = append(queue, other)
+				}
+			}
+		}
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// conflictingGroup reports whether group must be resolved by picking a
+// single winner rather than merged: either two rules resolve to the same
+// label path (this catches both a literal duplicate host and an exact host
+// vs. its own "*."-rooted wildcard -- e.g. "news.cnn.com" and
+// "*.news.cnn.com" are disjoint sibling scopes, not one containing the
+// other, even though moreSpecificHost would otherwise call them a tie), or
+// some port number is claimed with two different protocols.
+func conflictingGroup(rules map[string]*proxyconfig.EgressRule, group []string) bool {
+	paths := make(map[string]bool, len(group))
+	for _, name := range group {
+		labels, _ := reversedLabels(rules[name].Destination.GetService())
+		path := strings.Join(labels, ".")
+		if paths[path] {
+			return true
+		}
+		paths[path] = true
+	}
+
+	protoByPort := make(map[int32]string)
+	for _, name := range group {
+		for _, p := range rules[name].Ports {
+			if proto, ok := protoByPort[p.Port]; ok {
+				if proto != p.Protocol {
+					return true
+				}
+				continue
+			}
+			protoByPort[p.Port] = p.Protocol
+		}
+	}
+
+	return false
+}
+
+// conflictError reports the first port/protocol the loser and winner
+// actually share, falling back to the loser's first declared port if they
+// happen to share none (e.g. two rules declaring the identical host with
+// disjoint ports are still a conflict, just not on a specific port).
+func conflictError(rules map[string]*proxyconfig.EgressRule, loser, winner string) error {
+	winnerPorts := make(map[int32]string, len(rules[winner].Ports))
+	for _, p := range rules[winner].Ports {
+		winnerPorts[p.Port] = p.Protocol
+	}
+
+	host := rules[loser].Destination.GetService()
+	for _, p := range rules[loser].Ports {
+		if _, ok := winnerPorts[p.Port]; ok {
+			return &EgressRuleConflict{LosingRule: loser, WinningRule: winner, Host: host, Port: p.Port, Protocol: p.Protocol}
+		}
+	}
+
+	if len(rules[loser].Ports) > 0 {
+		p := rules[loser].Ports[0]
+		return &EgressRuleConflict{LosingRule: loser, WinningRule: winner, Host: host, Port: p.Port, Protocol: p.Protocol}
+	}
+	return &EgressRuleConflict{LosingRule: loser, WinningRule: winner, Host: host}
+}
+
+// mergeGroup synthesizes a single rule covering the union of ports
+// declared by every rule in group, keyed under group[0] -- the winner as
+// already picked by rankRules. The synthesized host is the most specific
+// one declared in the group as judged by moreSpecificHost: the deepest
+// label path wins, and hosts of equal depth (e.g. two sibling subdomains
+// joined into one group through a shared wildcard) are tie-broken
+// alphabetically, so only one of them is carried into the merged rule.
+// conflictingGroup has already rejected groups in which two rules share a
+// label path.
+func mergeGroup(rules map[string]*proxyconfig.EgressRule, group []string) (string, *proxyconfig.EgressRule) {
+	winner := group[0]
+
+	host := rules[winner].Destination.GetService()
+	for _, name := range group[1:] {
+		if moreSpecificHost(rules[name].Destination.GetService(), host) {
+			host = rules[name].Destination.GetService()
+		}
+	}
+
+	seen := make(map[int32]bool)
+	var ports []*proxyconfig.EgressRule_Port
+	for _, name := range group {
+		for _, p := range rules[name].Ports {
+			if seen[p.Port] {
+				continue
+			}
+			seen[p.Port] = true
+			ports = append(ports, p)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+
+	return winner, &proxyconfig.EgressRule{
+		Destination: &proxyconfig.IstioService{Service: host},
+		Ports:       ports,
+	}
+}
+
+// moreSpecificHost reports whether candidate is a strictly more specific
+// host than current (i.e. candidate's reversed-label path is longer),
+// breaking ties alphabetically so the result never depends on group order.
+func moreSpecificHost(candidate, current string) bool {
+	cl, _ := reversedLabels(candidate)
+	ol, _ := reversedLabels(current)
+	if len(cl) != len(ol) {
+		return len(cl) > len(ol)
+	}
+	return candidate < current
+}
+
+// hostTrie indexes egress rule hosts by DNS label, TLD-first, so that
+// wildcard/subdomain overlap between hosts like "*.cnn.com",
+// "news.cnn.com" and "*.news.cnn.com" can be found by walking parent/child
+// relationships instead of comparing every pair of hosts as strings.
+type hostTrie struct {
+	root *hostTrieNode
+}
+
+type hostTrieNode struct {
+	children  map[string]*hostTrieNode
+	wildcards []string // rule names whose wildcard host terminates here
+	exact     []string // rule names whose literal host terminates here
+}
+
+func newHostTrie() *hostTrie {
+	return &hostTrie{root: newHostTrieNode()}
+}
+
+func newHostTrieNode() *hostTrieNode {
+	return &hostTrieNode{children: make(map[string]*hostTrieNode)}
+}
+
+// reversedLabels splits host into its DNS labels in TLD-first order,
+// stripping a leading "*" or "*." wildcard marker. "*cnn.com", "*.cnn.com"
+// and "cnn.com" all normalize to the same label path; only the returned
+// wildcard flag distinguishes a wildcard host from a literal one.
+func reversedLabels(host string) (labels []string, wildcard bool) {
+	wildcard = strings.HasPrefix(host, "*")
+	host = strings.TrimPrefix(host, "*")
+	host = strings.TrimPrefix(host, ".")
+
+	parts := strings.Split(host, ".")
+	labels = make([]string, len(parts))
+	for i, p := range parts {
+		labels[len(parts)-1-i] = p
+	}
+	return labels, wildcard
+}
+
+func (t *hostTrie) insert(name, host string) {
+	labels, wildcard := reversedLabels(host)
+	node := t.root
+	for _, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			child = newHostTrieNode()
+			node.children[label] = child
+		}
+		node = child
+	}
+	if wildcard {
+		node.wildcards = append(node.wildcards, name)
+	} else {
+		node.exact = append(node.exact, name)
+	}
+}
+
+// overlapping returns the names (other than self) of every rule whose host
+// overlaps host: any wildcard recorded on the path down to host's node,
+// anything exact or wildcard at that same node, and -- if host is itself a
+// wildcard -- everything at or below its node.
+func (t *hostTrie) overlapping(host, self string) []string {
+	labels, wildcard := reversedLabels(host)
+
+	node := t.root
+	var overlaps []string
+	for _, label := range labels {
+		overlaps = append(overlaps, node.wildcards...)
+		child, ok := node.children[label]
+		if !ok {
+			return withoutName(overlaps, self)
+		}
+		node = child
+	}
+
+	overlaps = append(overlaps, node.wildcards...)
+	overlaps = append(overlaps, node.exact...)
+	if wildcard {
+		overlaps = append(overlaps, descendantNames(node)...)
+	}
+
+	return withoutName(overlaps, self)
+}
+
+func descendantNames(node *hostTrieNode) []string {
+	var names []string
+	names = append(names, node.exact...)
+	names = append(names, node.wildcards...)
+	for _, child := range node.children {
+		names = append(names, descendantNames(child)...)
+	}
+	return names
+}
+
+func withoutName(names []string, exclude string) []string {
+	out := names[:0]
+	for _, n := range names {
+		if n != exclude {
+			out = append(out, n)
+		}
+	}
+	return out
+}
@@ -17,6 +17,7 @@ package model_test
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	proxyconfig "istio.io/api/proxy/v1/config"
 	"istio.io/istio/pilot/model"
@@ -175,17 +176,195 @@ func TestRejectConflictingEgressRules(t *testing.T) {
 				},
 			},
 			valid: false},
+		{name: "wildcard overlaps a subdomain, disjoint ports are merged",
+			in: map[string]*proxyconfig.EgressRule{"wild": {
+				Destination: &proxyconfig.IstioService{
+					Service: "*.cnn.com",
+				},
+				Ports: []*proxyconfig.EgressRule_Port{
+					{Port: 80, Protocol: "http"},
+					{Port: 443, Protocol: "https"},
+				},
+			},
+				"news": {
+					Destination: &proxyconfig.IstioService{
+						Service: "news.cnn.com",
+					},
+					Ports: []*proxyconfig.EgressRule_Port{
+						{Port: 8080, Protocol: "http"},
+					},
+				},
+			},
+			out: map[string]*proxyconfig.EgressRule{
+				"news": {
+					Destination: &proxyconfig.IstioService{
+						Service: "news.cnn.com",
+					},
+					Ports: []*proxyconfig.EgressRule_Port{
+						{Port: 80, Protocol: "http"},
+						{Port: 443, Protocol: "https"},
+						{Port: 8080, Protocol: "http"},
+					},
+				},
+			},
+			valid: true},
+		{name: "wildcard overlaps a subdomain, conflicting protocol on a shared port",
+			in: map[string]*proxyconfig.EgressRule{"wild": {
+				Destination: &proxyconfig.IstioService{
+					Service: "*.cnn.com",
+				},
+				Ports: []*proxyconfig.EgressRule_Port{
+					{Port: 80, Protocol: "http"},
+				},
+			},
+				"news": {
+					Destination: &proxyconfig.IstioService{
+						Service: "news.cnn.com",
+					},
+					Ports: []*proxyconfig.EgressRule_Port{
+						{Port: 80, Protocol: "https"},
+					},
+				},
+			},
+			out: map[string]*proxyconfig.EgressRule{
+				"news": {
+					Destination: &proxyconfig.IstioService{
+						Service: "news.cnn.com",
+					},
+					Ports: []*proxyconfig.EgressRule_Port{
+						{Port: 80, Protocol: "https"},
+					},
+				},
+			},
+			valid: false},
+		{name: "exact host vs its own wildcard, disjoint ports, must conflict not merge",
+			in: map[string]*proxyconfig.EgressRule{"apex": {
+				Destination: &proxyconfig.IstioService{
+					Service: "news.cnn.com",
+				},
+				Ports: []*proxyconfig.EgressRule_Port{
+					{Port: 80, Protocol: "http"},
+				},
+			},
+				"sub": {
+					Destination: &proxyconfig.IstioService{
+						Service: "*.news.cnn.com",
+					},
+					Ports: []*proxyconfig.EgressRule_Port{
+						{Port: 443, Protocol: "https"},
+					},
+				},
+			},
+			// "*.news.cnn.com" only matches strict subdomains of
+			// news.cnn.com, not news.cnn.com itself, so it is a disjoint
+			// sibling scope rather than a superset: merging would wrongly
+			// grant port 80/http to every subdomain. They must conflict
+			// instead, with "apex" winning alphabetically.
+			out: map[string]*proxyconfig.EgressRule{
+				"apex": {
+					Destination: &proxyconfig.IstioService{
+						Service: "news.cnn.com",
+					},
+					Ports: []*proxyconfig.EgressRule_Port{
+						{Port: 80, Protocol: "http"},
+					},
+				},
+			},
+			valid: false},
 	}
 
 	for _, c := range cases {
-		got, errs := model.RejectConflictingEgressRules(c.in)
+		got, errs := model.RejectConflictingEgressRules(c.in, nil)
 		if (errs == nil) != c.valid {
 			t.Errorf("RejectConflictingEgressRules failed on %s: got valid=%v but wanted valid=%v",
 				c.name, errs == nil, c.valid)
 		}
 		if !reflect.DeepEqual(got, c.out) {
-			t.Errorf("RejectConflictingEgressRules failed on %s: got=%v but wanted %v: %v",
-				c.name, got, c.in)
+			t.Errorf("RejectConflictingEgressRules failed on %s: got=%v but wanted %v",
+				c.name, got, c.out)
 		}
 	}
 }
+
+func TestRejectConflictingEgressRulesStructuredConflict(t *testing.T) {
+	in := map[string]*proxyconfig.EgressRule{
+		"wild": {
+			Destination: &proxyconfig.IstioService{Service: "*.cnn.com"},
+			Ports:       []*proxyconfig.EgressRule_Port{{Port: 80, Protocol: "http"}},
+		},
+		"news": {
+			Destination: &proxyconfig.IstioService{Service: "news.cnn.com"},
+			Ports:       []*proxyconfig.EgressRule_Port{{Port: 80, Protocol: "https"}},
+		},
+	}
+
+	_, errs := model.RejectConflictingEgressRules(in, nil)
+	if len(errs) != 1 {
+		t.Fatalf("RejectConflictingEgressRules: got %d errors, wanted 1: %v", len(errs), errs)
+	}
+
+	conflict, ok := errs[0].(*model.EgressRuleConflict)
+	if !ok {
+		t.Fatalf("RejectConflictingEgressRules: error %v is not an *model.EgressRuleConflict", errs[0])
+	}
+	if conflict.LosingRule != "wild" || conflict.WinningRule != "news" || conflict.Port != 80 || conflict.Protocol != "http" {
+		t.Errorf("RejectConflictingEgressRules: got conflict %+v, wanted LosingRule=wild WinningRule=news Port=80 Protocol=http", conflict)
+	}
+}
+
+func TestRejectConflictingEgressRulesExplicitPriority(t *testing.T) {
+	in := map[string]*proxyconfig.EgressRule{
+		"cnn1": {
+			Destination: &proxyconfig.IstioService{Service: "*cnn.com"},
+			Ports:       []*proxyconfig.EgressRule_Port{{Port: 80, Protocol: "http"}},
+		},
+		"cnn2": {
+			Destination: &proxyconfig.IstioService{Service: "*cnn.com"},
+			Ports:       []*proxyconfig.EgressRule_Port{{Port: 80, Protocol: "http"}},
+		},
+	}
+	// Alphabetically cnn1 would win; an explicit higher Priority on cnn2
+	// must override that.
+	priorities := map[string]model.EgressRulePriority{
+		"cnn2": {Priority: 10},
+	}
+
+	got, errs := model.RejectConflictingEgressRules(in, priorities)
+	if len(errs) != 1 {
+		t.Fatalf("RejectConflictingEgressRules: got %d errors, wanted 1: %v", len(errs), errs)
+	}
+	if _, ok := got["cnn2"]; !ok {
+		t.Errorf("RejectConflictingEgressRules: got %v, wanted cnn2 (higher Priority) to win over cnn1", got)
+	}
+	if conflict, ok := errs[0].(*model.EgressRuleConflict); !ok || conflict.LosingRule != "cnn1" || conflict.WinningRule != "cnn2" {
+		t.Errorf("RejectConflictingEgressRules: got conflict %+v, wanted LosingRule=cnn1 WinningRule=cnn2", errs[0])
+	}
+}
+
+func TestRejectConflictingEgressRulesCreationTimestampFallback(t *testing.T) {
+	in := map[string]*proxyconfig.EgressRule{
+		"cnn1": {
+			Destination: &proxyconfig.IstioService{Service: "*cnn.com"},
+			Ports:       []*proxyconfig.EgressRule_Port{{Port: 80, Protocol: "http"}},
+		},
+		"cnn2": {
+			Destination: &proxyconfig.IstioService{Service: "*cnn.com"},
+			Ports:       []*proxyconfig.EgressRule_Port{{Port: 80, Protocol: "http"}},
+		},
+	}
+	now := time.Unix(1000, 0)
+	// Equal Priority (both zero); cnn2 was created earlier and must win
+	// even though cnn1 sorts first alphabetically.
+	priorities := map[string]model.EgressRulePriority{
+		"cnn1": {CreationTimestamp: now.Add(time.Minute)},
+		"cnn2": {CreationTimestamp: now},
+	}
+
+	got, errs := model.RejectConflictingEgressRules(in, priorities)
+	if len(errs) != 1 {
+		t.Fatalf("RejectConflictingEgressRules: got %d errors, wanted 1: %v", len(errs), errs)
+	}
+	if _, ok := got["cnn2"]; !ok {
+		t.Errorf("RejectConflictingEgressRules: got %v, wanted cnn2 (earlier CreationTimestamp) to win over cnn1", got)
+	}
+}
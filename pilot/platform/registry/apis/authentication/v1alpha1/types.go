@@ -0,0 +1,82 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1alpha1 defines the IdentityMapping custom resource, which is
+// the persistent, API-server-backed source of truth for the identity
+// mappings reconciled into security/pkg/registry.Registry.
+package v1alpha1
+
+import (
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IdentityMappingPhase is the observed reconciliation state of an
+// IdentityMapping.
+type IdentityMappingPhase string
+
+const (
+	// IdentityMappingBound means the mapping was accepted and is active in
+	// the in-process Registry used by the CA's CSR authorization check.
+	IdentityMappingBound IdentityMappingPhase = "Bound"
+	// IdentityMappingConflict means another IdentityMapping already claims
+	// the same source with a different target, so this one was rejected.
+	IdentityMappingConflict IdentityMappingPhase = "Conflict"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IdentityMapping is the Schema for the identitymappings API. It declares
+// that a workload authenticating as spec.source may be issued a
+// certificate for identity spec.target; CA's Check path consults the
+// reconciled in-memory registry rather than the API server directly.
+type IdentityMapping struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IdentityMappingSpec   `json:"spec"`
+	Status IdentityMappingStatus `json:"status,omitempty"`
+}
+
+// IdentityMappingSpec declares the desired source -> target identity
+// mapping.
+type IdentityMappingSpec struct {
+	// Source is the identity (e.g. a Kubernetes service account name) that
+	// is allowed to request certificates for Target.
+	Source string `json:"source"`
+	// Target is the identity Source is allowed to authenticate as.
+	Target string `json:"target"`
+}
+
+// IdentityMappingStatus reflects whether a mapping is currently in effect.
+type IdentityMappingStatus struct {
+	// Phase is "Bound" once the mapping has been reconciled into the
+	// registry, or "Conflict" if another IdentityMapping with the same
+	// Source and a different Target, created no later than this one,
+	// already holds that Source.
+	Phase IdentityMappingPhase `json:"phase,omitempty"`
+	// Reason is a short human-readable explanation, populated when Phase
+	// is Conflict (e.g. naming the IdentityMapping that won).
+	Reason string `json:"reason,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// IdentityMappingList is a list of IdentityMapping resources.
+type IdentityMappingList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata,omitempty"`
+
+	Items []IdentityMapping `json:"items"`
+}
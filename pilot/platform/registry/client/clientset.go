@@ -0,0 +1,147 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is a hand-rolled, narrowly-scoped analogue of the typed
+// clientset/informer/lister trio that client-gen and informer-gen would
+// otherwise produce for the IdentityMapping CRD. It is kept small
+// deliberately: Registry only ever needs List/Watch/Get/Update(Status) on
+// one resource, so a generated tree of per-type interfaces would be pure
+// overhead here.
+package client
+
+import (
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+
+	"istio.io/istio/pilot/platform/registry/apis/authentication/v1alpha1"
+)
+
+func init() {
+	if err := v1alpha1.AddToScheme(scheme.Scheme); err != nil {
+		panic(err)
+	}
+}
+
+// Interface is the typed client surface the registry controller and
+// informer are built on.
+type Interface interface {
+	IdentityMappings(namespace string) IdentityMappingInterface
+}
+
+// Clientset is a typed client for the authentication.istio.io/v1alpha1 API
+// group, built over a generic REST client in the same way client-gen
+// output wraps rest.RESTClient.
+type Clientset struct {
+	restClient rest.Interface
+}
+
+// NewForConfig builds a Clientset from a rest.Config, registering the
+// IdentityMapping types against the config's negotiated serializer.
+func NewForConfig(c *rest.Config) (*Clientset, error) {
+	config := *c
+	config.GroupVersion = &v1alpha1.SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.ContentConfig.NegotiatedSerializer = serializer.NewCodecFactory(scheme.Scheme)
+	config.UserAgent = rest.DefaultKubernetesUserAgent()
+
+	restClient, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &Clientset{restClient: restClient}, nil
+}
+
+// IdentityMappings returns the typed client for IdentityMapping objects in
+// namespace.
+func (c *Clientset) IdentityMappings(namespace string) IdentityMappingInterface {
+	return &identityMappings{client: c.restClient, ns: namespace}
+}
+
+// IdentityMappingInterface mirrors the generated per-resource client
+// interface: List/Watch/Get for the informer, Update/UpdateStatus for the
+// reconciler to report conflicts back to the API server.
+type IdentityMappingInterface interface {
+	List(opts meta_v1.ListOptions) (*v1alpha1.IdentityMappingList, error)
+	Watch(opts meta_v1.ListOptions) (watch.Interface, error)
+	Get(name string, opts meta_v1.GetOptions) (*v1alpha1.IdentityMapping, error)
+	Update(m *v1alpha1.IdentityMapping) (*v1alpha1.IdentityMapping, error)
+	UpdateStatus(m *v1alpha1.IdentityMapping) (*v1alpha1.IdentityMapping, error)
+}
+
+type identityMappings struct {
+	client rest.Interface
+	ns     string
+}
+
+const resourcePlural = "identitymappings"
+
+func (c *identityMappings) List(opts meta_v1.ListOptions) (*v1alpha1.IdentityMappingList, error) {
+	result := &v1alpha1.IdentityMappingList{}
+	err := c.client.Get().
+		Namespace(c.ns).
+		Resource(resourcePlural).
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *identityMappings) Watch(opts meta_v1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.client.Get().
+		Namespace(c.ns).
+		Resource(resourcePlural).
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Watch()
+}
+
+func (c *identityMappings) Get(name string, opts meta_v1.GetOptions) (*v1alpha1.IdentityMapping, error) {
+	result := &v1alpha1.IdentityMapping{}
+	err := c.client.Get().
+		Namespace(c.ns).
+		Resource(resourcePlural).
+		Name(name).
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *identityMappings) Update(m *v1alpha1.IdentityMapping) (*v1alpha1.IdentityMapping, error) {
+	result := &v1alpha1.IdentityMapping{}
+	err := c.client.Put().
+		Namespace(c.ns).
+		Resource(resourcePlural).
+		Name(m.Name).
+		Body(m).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func (c *identityMappings) UpdateStatus(m *v1alpha1.IdentityMapping) (*v1alpha1.IdentityMapping, error) {
+	result := &v1alpha1.IdentityMapping{}
+	err := c.client.Put().
+		Namespace(c.ns).
+		Resource(resourcePlural).
+		Name(m.Name).
+		SubResource("status").
+		Body(m).
+		Do().
+		Into(result)
+	return result, err
+}
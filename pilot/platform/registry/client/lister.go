@@ -0,0 +1,81 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/platform/registry/apis/authentication/v1alpha1"
+)
+
+// IdentityMappingLister reads IdentityMapping objects out of a shared
+// informer's indexer, the same read path generated listers provide.
+type IdentityMappingLister struct {
+	indexer cache.Indexer
+}
+
+// NewIdentityMappingLister wraps the indexer of a SharedIndexInformer
+// created by NewIdentityMappingInformer.
+func NewIdentityMappingLister(indexer cache.Indexer) *IdentityMappingLister {
+	return &IdentityMappingLister{indexer: indexer}
+}
+
+// List returns all IdentityMapping objects matching selector across all
+// namespaces.
+func (l *IdentityMappingLister) List(selector labels.Selector) ([]*v1alpha1.IdentityMapping, error) {
+	var result []*v1alpha1.IdentityMapping
+	err := cache.ListAll(l.indexer, selector, func(m interface{}) {
+		result = append(result, m.(*v1alpha1.IdentityMapping))
+	})
+	return result, err
+}
+
+// IdentityMappings returns a namespace-scoped view of the lister.
+func (l *IdentityMappingLister) IdentityMappings(namespace string) IdentityMappingNamespaceLister {
+	return IdentityMappingNamespaceLister{indexer: l.indexer, namespace: namespace}
+}
+
+// IdentityMappingNamespaceLister lists/gets IdentityMapping objects scoped
+// to one namespace.
+type IdentityMappingNamespaceLister struct {
+	indexer   cache.Indexer
+	namespace string
+}
+
+// List returns IdentityMapping objects in the namespace matching selector.
+func (l IdentityMappingNamespaceLister) List(selector labels.Selector) ([]*v1alpha1.IdentityMapping, error) {
+	var result []*v1alpha1.IdentityMapping
+	err := cache.ListAllByNamespace(l.indexer, l.namespace, selector, func(m interface{}) {
+		result = append(result, m.(*v1alpha1.IdentityMapping))
+	})
+	return result, err
+}
+
+// Get returns the named IdentityMapping in the namespace. It returns a
+// standard apierrors "not found" error (checkable with
+// apierrors.IsNotFound) when the object isn't in the indexer, matching
+// what generated listers return.
+func (l IdentityMappingNamespaceLister) Get(name string) (*v1alpha1.IdentityMapping, error) {
+	obj, exists, err := l.indexer.GetByKey(l.namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apierrors.NewNotFound(v1alpha1.Resource("identitymappings"), name)
+	}
+	return obj.(*v1alpha1.IdentityMapping), nil
+}
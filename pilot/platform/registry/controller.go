@@ -0,0 +1,238 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package registry reconciles IdentityMapping custom resources into the
+// in-process security/pkg/registry.Registry the CA consults on its CSR
+// authorization path. The API server is the source of truth -- mappings
+// survive Pilot/CA restarts, can be GitOps-managed, and multiple CA
+// replicas watching the same IdentityMappings converge on the same
+// in-memory state -- while Check itself stays an uncontended in-memory map
+// lookup.
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"istio.io/istio/pilot/platform/registry/apis/authentication/v1alpha1"
+	"istio.io/istio/pilot/platform/registry/client"
+	"istio.io/istio/security/pkg/registry"
+)
+
+// owner records which IdentityMapping currently holds a given source
+// identity, so a later IdentityMapping claiming the same source with a
+// different target can be detected and rejected as a conflict.
+type owner struct {
+	key               string // namespace/name of the owning IdentityMapping
+	creationTimestamp meta_v1.Time
+	target            string
+}
+
+// Controller watches IdentityMapping custom resources and reconciles them
+// into a registry.Registry, using the same informer/workqueue shape as
+// registry.Controller (security/pkg/registry) uses for Kubernetes Services.
+type Controller struct {
+	client   client.Interface
+	registry registry.Registry
+
+	informer cache.SharedIndexInformer
+	lister   *client.IdentityMappingLister
+	queue    workqueue.RateLimitingInterface
+
+	mu sync.Mutex
+	// owners maps a source identity to the IdentityMapping currently
+	// bound to it.
+	owners map[string]owner
+	// lastSource maps an IdentityMapping's key to the source it was bound
+	// under as of the last successful reconcile, so that editing
+	// spec.source in place (or deleting the object outright) can release
+	// the mapping for the *previous* source instead of leaking it in the
+	// Registry forever.
+	lastSource map[string]string
+}
+
+// NewController creates a Controller watching IdentityMapping objects in
+// namespace (meta_v1.NamespaceAll for cluster-wide) and reconciling them
+// into reg every resyncPeriod.
+func NewController(c client.Interface, reg registry.Registry, namespace string, resyncPeriod time.Duration) *Controller {
+	informer := client.NewIdentityMappingInformer(c, namespace, resyncPeriod)
+
+	ctrl := &Controller{
+		client:     c,
+		registry:   reg,
+		informer:   informer,
+		lister:     client.NewIdentityMappingLister(informer.GetIndexer()),
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		owners:     make(map[string]owner),
+		lastSource: make(map[string]string),
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueue,
+		UpdateFunc: func(_, new interface{}) { ctrl.enqueue(new) },
+		DeleteFunc: ctrl.enqueue,
+	})
+
+	return ctrl
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the informer and workers workers, blocking until stopCh is
+// closed.
+func (c *Controller) Run(workers int, stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	glog.Info("Starting IdentityMapping controller")
+
+	go c.informer.Run(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for IdentityMapping controller caches to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	glog.Info("Stopping IdentityMapping controller")
+	return nil
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error syncing IdentityMapping %q, requeuing: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile reconciles a single IdentityMapping (identified by
+// namespace/name key) against the in-process Registry, rejecting it with a
+// Conflict status if another IdentityMapping already owns its source with
+// a different target.
+func (c *Controller) reconcile(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	m, err := c.lister.IdentityMappings(namespace).Get(name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			c.releaseOwnership(key)
+			return nil
+		}
+		return err
+	}
+	m = m.DeepCopy()
+
+	c.mu.Lock()
+	// spec.source may have been edited in place since the last reconcile;
+	// release whatever it used to own before considering the new source,
+	// or the old source -> target mapping would live in the Registry
+	// forever even though no IdentityMapping claims it anymore.
+	if oldSource, tracked := c.lastSource[key]; tracked && oldSource != m.Spec.Source {
+		c.releaseSourceLocked(key, oldSource)
+	}
+
+	existing, claimed := c.owners[m.Spec.Source]
+	conflict := claimed && existing.key != key && existing.target != m.Spec.Target
+	if conflict {
+		// Deterministic tie-break: whichever IdentityMapping was created
+		// first keeps ownership, mirroring the k8s convention of favoring
+		// the earlier resource when two competing objects disagree.
+		conflict = !m.CreationTimestamp.Before(&existing.creationTimestamp)
+	}
+	if !conflict {
+		c.owners[m.Spec.Source] = owner{key: key, creationTimestamp: m.CreationTimestamp, target: m.Spec.Target}
+	}
+	c.lastSource[key] = m.Spec.Source
+	c.mu.Unlock()
+
+	if conflict {
+		c.registry.DeleteMapping(m.Spec.Source, m.Spec.Target)
+		return c.updateStatus(namespace, name, m, v1alpha1.IdentityMappingConflict,
+			fmt.Sprintf("source %q is already bound to target %q by %q", m.Spec.Source, existing.target, existing.key))
+	}
+
+	c.registry.AddMapping(m.Spec.Source, m.Spec.Target)
+	return c.updateStatus(namespace, name, m, v1alpha1.IdentityMappingBound, "")
+}
+
+// releaseOwnership releases whatever source key was last reconciled under,
+// for use when the IdentityMapping itself has been deleted entirely.
+func (c *Controller) releaseOwnership(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	source, tracked := c.lastSource[key]
+	if !tracked {
+		return
+	}
+	c.releaseSourceLocked(key, source)
+	delete(c.lastSource, key)
+}
+
+// releaseSourceLocked clears source from the Registry and from c.owners if
+// key is still its recorded owner. c.mu must be held by the caller.
+func (c *Controller) releaseSourceLocked(key, source string) {
+	o, ok := c.owners[source]
+	if !ok || o.key != key {
+		return
+	}
+	c.registry.DeleteMapping(source, o.target)
+	delete(c.owners, source)
+}
+
+func (c *Controller) updateStatus(namespace, name string, m *v1alpha1.IdentityMapping, phase v1alpha1.IdentityMappingPhase, reason string) error {
+	if m.Status.Phase == phase && m.Status.Reason == reason {
+		return nil
+	}
+	m.Status.Phase = phase
+	m.Status.Reason = reason
+	_, err := c.client.IdentityMappings(namespace).UpdateStatus(m)
+	return err
+}
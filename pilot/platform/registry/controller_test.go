@@ -0,0 +1,255 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/platform/registry/apis/authentication/v1alpha1"
+	"istio.io/istio/pilot/platform/registry/client"
+)
+
+// fakeRegistry is a minimal in-memory registry.Registry used so these
+// tests exercise Controller.reconcile in isolation, without reaching into
+// security/pkg/registry's unexported types.
+type fakeRegistry struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{m: make(map[string]string)}
+}
+
+func (f *fakeRegistry) Check(id1, id2 string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.m[id1] == id2
+}
+
+func (f *fakeRegistry) AddMapping(id1, id2 string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.m[id1] = id2
+}
+
+func (f *fakeRegistry) AddMappingWithTTL(id1, id2 string, _ time.Duration) {
+	f.AddMapping(id1, id2)
+}
+
+func (f *fakeRegistry) DeleteMapping(id1, id2 string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.m[id1] == id2 {
+		delete(f.m, id1)
+	}
+}
+
+func (f *fakeRegistry) get(id1 string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target, ok := f.m[id1]
+	return target, ok
+}
+
+// fakeClient is a minimal client.Interface that records the last
+// UpdateStatus call per object, without touching the network.
+type fakeClient struct {
+	mu       sync.Mutex
+	statuses map[string]*v1alpha1.IdentityMapping // namespace/name -> last updated object
+}
+
+// fakeIdentityMappings backs fakeClient.IdentityMappings.
+type fakeIdentityMappings struct {
+	client    *fakeClient
+	namespace string
+}
+
+func (f *fakeClient) IdentityMappings(namespace string) client.IdentityMappingInterface {
+	return fakeIdentityMappings{client: f, namespace: namespace}
+}
+
+func (f fakeIdentityMappings) List(meta_v1.ListOptions) (*v1alpha1.IdentityMappingList, error) {
+	return &v1alpha1.IdentityMappingList{}, nil
+}
+
+func (f fakeIdentityMappings) Watch(meta_v1.ListOptions) (watch.Interface, error) {
+	return watch.NewFake(), nil
+}
+
+func (f fakeIdentityMappings) Get(name string, _ meta_v1.GetOptions) (*v1alpha1.IdentityMapping, error) {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+	m, ok := f.client.statuses[f.namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1alpha1.Resource("identitymappings"), name)
+	}
+	return m.DeepCopy(), nil
+}
+
+func (f fakeIdentityMappings) Update(m *v1alpha1.IdentityMapping) (*v1alpha1.IdentityMapping, error) {
+	return f.UpdateStatus(m)
+}
+
+func (f fakeIdentityMappings) UpdateStatus(m *v1alpha1.IdentityMapping) (*v1alpha1.IdentityMapping, error) {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+	if f.client.statuses == nil {
+		f.client.statuses = make(map[string]*v1alpha1.IdentityMapping)
+	}
+	f.client.statuses[f.namespace+"/"+m.Name] = m.DeepCopy()
+	return m, nil
+}
+
+func (f *fakeClient) status(namespace, name string) *v1alpha1.IdentityMapping {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statuses[namespace+"/"+name]
+}
+
+func newIdentityMapping(namespace, name, source, target string, created time.Time) *v1alpha1.IdentityMapping {
+	return &v1alpha1.IdentityMapping{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace:         namespace,
+			Name:              name,
+			CreationTimestamp: meta_v1.NewTime(created),
+		},
+		Spec: v1alpha1.IdentityMappingSpec{Source: source, Target: target},
+	}
+}
+
+// newTestController builds a Controller wired to a plain indexer (no
+// informer/REST round trip needed to exercise reconcile) and the fakes
+// above.
+func newTestController() (*Controller, *fakeRegistry, *fakeClient, cache.Indexer) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	fr := newFakeRegistry()
+	fc := &fakeClient{}
+	ctrl := &Controller{
+		client:     fc,
+		registry:   fr,
+		lister:     client.NewIdentityMappingLister(indexer),
+		owners:     make(map[string]owner),
+		lastSource: make(map[string]string),
+	}
+	return ctrl, fr, fc, indexer
+}
+
+func TestReconcileBindsMapping(t *testing.T) {
+	ctrl, fr, fc, indexer := newTestController()
+
+	m := newIdentityMapping("default", "a", "s1", "t1", time.Unix(1, 0))
+	if err := indexer.Add(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctrl.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if target, ok := fr.get("s1"); !ok || target != "t1" {
+		t.Errorf("registry mapping for s1 = (%q, %v), want (t1, true)", target, ok)
+	}
+	if status := fc.status("default", "a"); status == nil || status.Status.Phase != v1alpha1.IdentityMappingBound {
+		t.Errorf("status = %v, want phase Bound", status)
+	}
+}
+
+func TestReconcileSourceEditReleasesOldMapping(t *testing.T) {
+	ctrl, fr, _, indexer := newTestController()
+
+	m := newIdentityMapping("default", "a", "s1", "t1", time.Unix(1, 0))
+	if err := indexer.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if target, ok := fr.get("s1"); !ok || target != "t1" {
+		t.Fatalf("precondition: registry mapping for s1 = (%q, %v), want (t1, true)", target, ok)
+	}
+
+	m2 := newIdentityMapping("default", "a", "s2", "t1", time.Unix(1, 0))
+	if err := indexer.Update(m2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile after edit: %v", err)
+	}
+
+	if _, ok := fr.get("s1"); ok {
+		t.Errorf("registry still has a mapping for s1 after spec.source was edited away from it")
+	}
+	if target, ok := fr.get("s2"); !ok || target != "t1" {
+		t.Errorf("registry mapping for s2 = (%q, %v), want (t1, true)", target, ok)
+	}
+}
+
+func TestReconcileDeleteReleasesMapping(t *testing.T) {
+	ctrl, fr, _, indexer := newTestController()
+
+	m := newIdentityMapping("default", "a", "s1", "t1", time.Unix(1, 0))
+	if err := indexer.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if err := indexer.Delete(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctrl.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile after delete: %v", err)
+	}
+
+	if _, ok := fr.get("s1"); ok {
+		t.Errorf("registry still has a mapping for s1 after the owning IdentityMapping was deleted")
+	}
+}
+
+func TestReconcileConflictingSourceRejectsLater(t *testing.T) {
+	ctrl, fr, fc, indexer := newTestController()
+
+	first := newIdentityMapping("default", "first", "s1", "t1", time.Unix(1, 0))
+	second := newIdentityMapping("default", "second", "s1", "t2", time.Unix(2, 0))
+	if err := indexer.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Add(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctrl.reconcile("default/first"); err != nil {
+		t.Fatalf("reconcile first: %v", err)
+	}
+	if err := ctrl.reconcile("default/second"); err != nil {
+		t.Fatalf("reconcile second: %v", err)
+	}
+
+	if target, ok := fr.get("s1"); !ok || target != "t1" {
+		t.Errorf("registry mapping for s1 = (%q, %v), want (t1, true) -- the earlier-created IdentityMapping should win", target, ok)
+	}
+	if status := fc.status("default", "second"); status == nil || status.Status.Phase != v1alpha1.IdentityMappingConflict {
+		t.Errorf("status of later IdentityMapping = %v, want phase Conflict", status)
+	}
+}
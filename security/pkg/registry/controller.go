@@ -0,0 +1,217 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"istio.io/istio/pilot/platform/kube"
+)
+
+// Controller watches Kubernetes Services cluster-wide and reconciles the
+// KubeServiceAccountsOnVMAnnotation mappings it finds into a Registry. It
+// follows the standard k8s sample-controller shape: a SharedIndexInformer
+// feeds namespace/name keys into a rate-limited workqueue, and a pool of
+// worker goroutines pops keys, looks the Service up via the informer's
+// Lister, and reconciles the desired mapping into the Registry.
+//
+// Replacing the old synchronous K8SServiceAdded/Deleted/Updated callbacks
+// with this controller gives us retries (AddRateLimited on failure), a
+// periodic resync so the registry self-heals if it ever drifts from the
+// cluster state, and safe handling of delete events via
+// cache.DeletedFinalStateUnknown tombstones.
+type Controller struct {
+	registry Registry
+	ttl      time.Duration
+
+	informer cache.SharedIndexInformer
+	indexer  cache.Indexer
+	queue    workqueue.RateLimitingInterface
+
+	// lastSeen remembers the service account mapped for a given
+	// namespace/name key so that, on delete, we know what to clear from the
+	// registry even though the Service is already gone from the indexer by
+	// the time the key is popped off the queue.
+	mu       sync.Mutex
+	lastSeen map[string]string
+}
+
+// NewController creates a Controller that watches Services in all
+// namespaces with client and reconciles mappings into reg. resyncPeriod
+// controls how often the informer replays all known Services through the
+// workqueue, which bounds how long a drifted mapping can survive. Every
+// observed Service renews its mapping's TTL in reg by ttl (0 means the
+// mappings never expire); if a Service disappears without a clean delete
+// event, its mapping still ages out once ttl elapses since the last
+// observation.
+func NewController(client kubernetes.Interface, reg Registry, resyncPeriod, ttl time.Duration) *Controller {
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Services(meta_v1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Services(meta_v1.NamespaceAll).Watch(options)
+			},
+		},
+		&v1.Service{},
+		resyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+
+	c := &Controller{
+		registry: reg,
+		ttl:      ttl,
+		informer: informer,
+		indexer:  informer.GetIndexer(),
+		queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		lastSeen: make(map[string]string),
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, new interface{}) { c.enqueue(new) },
+		DeleteFunc: c.enqueue,
+	})
+
+	return c
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the informer and workers workers, blocking until stopCh is
+// closed. It returns an error if the initial cache sync fails.
+func (c *Controller) Run(workers int, stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	glog.Info("Starting identity registry controller")
+
+	go c.informer.Run(stopCh)
+
+	if !c.WaitForCacheSync(stopCh) {
+		return fmt.Errorf("timed out waiting for identity registry controller caches to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	glog.Info("Stopping identity registry controller")
+	return nil
+}
+
+// WaitForCacheSync blocks until the Service informer has completed its
+// initial list, or stopCh is closed.
+func (c *Controller) WaitForCacheSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, c.informer.HasSynced)
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error syncing %q, requeuing: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile brings the registry's mapping for key in line with the current
+// (or, for a deleted Service, last known) KubeServiceAccountsOnVMAnnotation.
+func (c *Controller) reconcile(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		c.mu.Lock()
+		svcAcct, seen := c.lastSeen[key]
+		delete(c.lastSeen, key)
+		c.mu.Unlock()
+		if seen {
+			c.registry.DeleteMapping(svcAcct, svcAcct)
+		}
+		return nil
+	}
+
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		return fmt.Errorf("object with key %q is not a *v1.Service", key)
+	}
+
+	svcAcct, ok := svc.ObjectMeta.Annotations[kube.KubeServiceAccountsOnVMAnnotation]
+	if !ok {
+		c.mu.Lock()
+		oldSvcAcct, seen := c.lastSeen[key]
+		delete(c.lastSeen, key)
+		c.mu.Unlock()
+		// The Service still exists but no longer carries the annotation;
+		// whatever it used to map must be cleared, or (with ttl == 0) it
+		// would authorize CSRs forever with nothing left to delete it.
+		if seen {
+			c.registry.DeleteMapping(oldSvcAcct, oldSvcAcct)
+		}
+		return nil
+	}
+
+	c.registry.AddMappingWithTTL(svcAcct, svcAcct, c.ttl)
+
+	c.mu.Lock()
+	oldSvcAcct, seen := c.lastSeen[key]
+	c.lastSeen[key] = svcAcct
+	c.mu.Unlock()
+	// The annotation may now name a different service account; clear the
+	// mapping for the one it used to name.
+	if seen && oldSvcAcct != svcAcct {
+		c.registry.DeleteMapping(oldSvcAcct, oldSvcAcct)
+	}
+
+	return nil
+}
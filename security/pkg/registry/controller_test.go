@@ -0,0 +1,199 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/platform/kube"
+)
+
+// fakeRegistry is a minimal Registry used to exercise Controller.reconcile
+// without depending on IdentityRegistry's unexported mapping type.
+type fakeRegistry struct {
+	mu  sync.Mutex
+	m   map[string]string
+	ttl map[string]time.Duration
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{m: make(map[string]string), ttl: make(map[string]time.Duration)}
+}
+
+func (f *fakeRegistry) Check(id1, id2 string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.m[id1] == id2
+}
+
+func (f *fakeRegistry) AddMapping(id1, id2 string) {
+	f.AddMappingWithTTL(id1, id2, 0)
+}
+
+func (f *fakeRegistry) AddMappingWithTTL(id1, id2 string, ttl time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.m[id1] = id2
+	f.ttl[id1] = ttl
+}
+
+func (f *fakeRegistry) DeleteMapping(id1, id2 string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.m[id1] == id2 {
+		delete(f.m, id1)
+		delete(f.ttl, id1)
+	}
+}
+
+func (f *fakeRegistry) get(id1 string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target, ok := f.m[id1]
+	return target, ok
+}
+
+func newService(namespace, name, svcAcct string) *v1.Service {
+	svc := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Namespace: namespace, Name: name}}
+	if svcAcct != "" {
+		svc.ObjectMeta.Annotations = map[string]string{kube.KubeServiceAccountsOnVMAnnotation: svcAcct}
+	}
+	return svc
+}
+
+// newTestController builds a Controller over a plain indexer, bypassing
+// the real Kubernetes informer/watch so reconcile can be driven directly.
+func newTestController(ttl time.Duration) (*Controller, *fakeRegistry, cache.Indexer) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	fr := newFakeRegistry()
+	c := &Controller{
+		registry: fr,
+		ttl:      ttl,
+		indexer:  indexer,
+		lastSeen: make(map[string]string),
+	}
+	return c, fr, indexer
+}
+
+func TestReconcileAddsMapping(t *testing.T) {
+	c, fr, indexer := newTestController(0)
+
+	svc := newService("default", "a", "sa1")
+	if err := indexer.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if target, ok := fr.get("sa1"); !ok || target != "sa1" {
+		t.Errorf("registry mapping for sa1 = (%q, %v), want (sa1, true)", target, ok)
+	}
+}
+
+func TestReconcileAnnotationRemovedReleasesMapping(t *testing.T) {
+	c, fr, indexer := newTestController(0)
+
+	svc := newService("default", "a", "sa1")
+	if err := indexer.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if _, ok := fr.get("sa1"); !ok {
+		t.Fatalf("precondition: expected sa1 to be mapped")
+	}
+
+	updated := newService("default", "a", "")
+	if err := indexer.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile after annotation removed: %v", err)
+	}
+
+	if _, ok := fr.get("sa1"); ok {
+		t.Errorf("registry still has a mapping for sa1 after its Service's annotation was removed")
+	}
+}
+
+func TestReconcileDeleteReleasesMapping(t *testing.T) {
+	c, fr, indexer := newTestController(0)
+
+	svc := newService("default", "a", "sa1")
+	if err := indexer.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if err := indexer.Delete(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile after delete: %v", err)
+	}
+
+	if _, ok := fr.get("sa1"); ok {
+		t.Errorf("registry still has a mapping for sa1 after its Service was deleted")
+	}
+}
+
+func TestReconcileRenewsTTLOnEveryObservation(t *testing.T) {
+	c, fr, indexer := newTestController(time.Minute)
+
+	svc := newService("default", "a", "sa1")
+	if err := indexer.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	fr.mu.Lock()
+	firstTTL := fr.ttl["sa1"]
+	fr.mu.Unlock()
+	if firstTTL != time.Minute {
+		t.Fatalf("ttl for sa1 = %v, want %v", firstTTL, time.Minute)
+	}
+
+	// A resync replays the same Service; the mapping's TTL must be renewed
+	// (not just left alone), since that's what lets a Service that exists
+	// without a clean delete event keep its mapping alive indefinitely.
+	fr.mu.Lock()
+	delete(fr.ttl, "sa1")
+	fr.mu.Unlock()
+	if err := c.reconcile("default/a"); err != nil {
+		t.Fatalf("reconcile on resync: %v", err)
+	}
+	if target, ok := fr.get("sa1"); !ok || target != "sa1" {
+		t.Errorf("registry mapping for sa1 = (%q, %v), want (sa1, true) after resync", target, ok)
+	}
+	fr.mu.Lock()
+	renewedTTL, renewed := fr.ttl["sa1"]
+	fr.mu.Unlock()
+	if !renewed || renewedTTL != time.Minute {
+		t.Errorf("ttl for sa1 after resync = (%v, %v), want (%v, true)", renewedTTL, renewed, time.Minute)
+	}
+}
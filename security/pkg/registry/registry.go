@@ -16,109 +16,158 @@ package registry
 
 import (
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
-	"k8s.io/api/core/v1"
-
-	"istio.io/istio/pilot/platform/kube"
 )
 
 // Registry is the standard interface for identity registry implementation
 type Registry interface {
 	Check(string, string) bool
 	AddMapping(string, string)
+	AddMappingWithTTL(string, string, time.Duration)
 	DeleteMapping(string, string)
 }
 
+// mapping is a single identity mapping entry. A zero expiresAt means the
+// mapping never expires.
+type mapping struct {
+	target    string
+	expiresAt time.Time
+}
+
+func (m mapping) expired(now time.Time) bool {
+	return !m.expiresAt.IsZero() && now.After(m.expiresAt)
+}
+
+// defaultEvictionInterval is how often GetIdentityRegistry's singleton
+// scans for and deletes expired mappings.
+const defaultEvictionInterval = 1 * time.Minute
+
 // IdentityRegistry is a naive registry that maintains a mapping between
 // identities (as strings): id1 -> id2, id3 -> id4, etc. The method call
 // Check(id1, id2) will succeed only if there is a mapping id1 -> id2 stored
-// in this registry.
+// in this registry and that mapping has not expired.
 //
 // CA can make authorization decisions based on this registry. By creating a
 // mapping id1 -> id2, CA will approve CSRs sent only by services running
 // as id1 for identity id2.
+//
+// Mappings are populated by Controller, which reconciles the desired state
+// from Kubernetes Services into this registry. AddMapping/DeleteMapping are
+// therefore idempotent set/clear operations: replaying the same mapping from
+// a workqueue retry must not be observably different from applying it once.
 type IdentityRegistry struct {
 	sync.RWMutex
-	Map map[string]string
+	Map map[string]mapping
 }
 
-// Check checks whether id1 is mapped to id2
+// Check checks whether id1 is mapped to id2 and that mapping has not
+// expired. Expiry is also checked lazily here (in addition to the
+// background eviction loop) so that a stopped or delayed eviction goroutine
+// can never cause an expired mapping to be treated as valid.
 func (reg *IdentityRegistry) Check(id1, id2 string) bool {
 	reg.RLock()
-	mapped, ok := reg.Map[id1]
+	m, ok := reg.Map[id1]
 	reg.RUnlock()
-	if !ok || id2 != mapped {
+	if !ok || m.expired(time.Now()) || id2 != m.target {
 		glog.Warningf("Identity %q does not exist or is not mapped to %q", id1, id2)
 		return false
 	}
 	return true
 }
 
-// AddMapping adds a mapping id1 -> id2
+// AddMapping sets the mapping id1 -> id2 with no expiration. It is
+// equivalent to AddMappingWithTTL(id1, id2, 0).
 func (reg *IdentityRegistry) AddMapping(id1, id2 string) {
-	reg.RLock()
-	oldID, ok := reg.Map[id1]
-	reg.RUnlock()
-	if ok {
-		glog.Warningf("Overwriting existing mapping: %q -> %q", id1, oldID)
-	}
+	reg.AddMappingWithTTL(id1, id2, 0)
+}
+
+// AddMappingWithTTL sets the mapping id1 -> id2, expiring it after ttl
+// (ttl == 0 means never expire). It is a compare-and-set under a single
+// lock: setting the same id1 -> id2 mapping again is a no-op for logging
+// purposes but still refreshes expiresAt, so callers that observe id1
+// repeatedly (e.g. a Service heartbeat) can renew the TTL by calling this
+// on every observation; once the underlying Service disappears and
+// observations stop, the mapping ages out on its own even if a delete
+// event is missed. It only warns when id1 is re-pointed at a different
+// id2.
+func (reg *IdentityRegistry) AddMappingWithTTL(id1, id2 string, ttl time.Duration) {
 	reg.Lock()
-	reg.Map[id1] = id2
-	reg.Unlock()
+	defer reg.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	if old, ok := reg.Map[id1]; ok && old.target != id2 {
+		glog.Warningf("Overwriting existing mapping: %q -> %q with %q -> %q", id1, old.target, id1, id2)
+	}
+	reg.Map[id1] = mapping{target: id2, expiresAt: expiresAt}
 }
 
-// DeleteMapping attempts to delete mapping id1 -> id2. If id1 is already
-// mapped to a different identity, deletion fails
+// DeleteMapping clears the mapping id1 -> id2 if it is currently set to id2
+// (regardless of whether it has expired). It is a no-op (not an error) if
+// the mapping is already absent, so that replayed or duplicate delete
+// events are safe.
 func (reg *IdentityRegistry) DeleteMapping(id1, id2 string) {
-	reg.RLock()
-	oldID, ok := reg.Map[id1]
-	reg.RUnlock()
-	if !ok || oldID != id2 {
-		glog.Warningf("Could not delete nonexistent mapping: %q -> %q", id1, id2)
+	reg.Lock()
+	defer reg.Unlock()
+	if old, ok := reg.Map[id1]; !ok || old.target != id2 {
 		return
 	}
-	reg.Lock()
 	delete(reg.Map, id1)
-	reg.Unlock()
 }
 
-var (
-	// singleton object of identity registry
-	reg Registry
-)
-
-// GetIdentityRegistry returns the identity registry object
-func GetIdentityRegistry() Registry {
-	if reg == nil {
-		reg = &IdentityRegistry{
-			Map: make(map[string]string),
+// evictExpired deletes every mapping that had expired as of now.
+func (reg *IdentityRegistry) evictExpired(now time.Time) {
+	reg.Lock()
+	defer reg.Unlock()
+	for id1, m := range reg.Map {
+		if m.expired(now) {
+			delete(reg.Map, id1)
 		}
 	}
-	return reg
 }
 
-// K8SServiceAdded is a handler used by k8s service controller to monitor
-// new services and to add their service accounts to registry, if exist
-func K8SServiceAdded(svc *v1.Service) {
-	svcAcct, ok := svc.ObjectMeta.Annotations[kube.KubeServiceAccountsOnVMAnnotation]
-	if ok {
-		GetIdentityRegistry().AddMapping(svcAcct, svcAcct)
+// runEvictionLoop periodically evicts expired mappings until the process
+// exits. It is the background half of expiration: Check's lazy check above
+// is what actually guarantees no expired mapping is ever honored, even if
+// this loop were somehow not running.
+func (reg *IdentityRegistry) runEvictionLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		reg.evictExpired(now)
 	}
 }
 
-// K8SServiceDeleted is a handler used by k8s service controller to monitor
-// deleted services and to remove their service accounts from registry
-func K8SServiceDeleted(svc *v1.Service) {
-	svcAcct, ok := svc.ObjectMeta.Annotations[kube.KubeServiceAccountsOnVMAnnotation]
-	if ok {
-		GetIdentityRegistry().DeleteMapping(svcAcct, svcAcct)
-	}
+var (
+	// singleton object of identity registry
+	reg     Registry
+	regOnce sync.Once
+)
+
+// GetIdentityRegistry returns the identity registry object, starting its
+// background eviction loop (at defaultEvictionInterval) the first time it
+// is created. Use GetIdentityRegistryWithEvictionInterval to configure that
+// interval instead.
+func GetIdentityRegistry() Registry {
+	return GetIdentityRegistryWithEvictionInterval(defaultEvictionInterval)
 }
 
-// K8SServiceUpdated is a handler used by k8s service controller to monitor
-// service updates and update the registry
-func K8SServiceUpdated(oldSvc, newSvc *v1.Service) {
-	K8SServiceDeleted(oldSvc)
-	K8SServiceAdded(newSvc)
+// GetIdentityRegistryWithEvictionInterval is GetIdentityRegistry with a
+// configurable eviction scan interval. Only the first call across either
+// function actually constructs the singleton and its eviction loop; later
+// calls (with any interval) just return the existing registry.
+func GetIdentityRegistryWithEvictionInterval(evictionInterval time.Duration) Registry {
+	regOnce.Do(func() {
+		r := &IdentityRegistry{
+			Map: make(map[string]mapping),
+		}
+		go r.runEvictionLoop(evictionInterval)
+		reg = r
+	})
+	return reg
 }
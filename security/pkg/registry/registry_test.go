@@ -0,0 +1,100 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRegistry() *IdentityRegistry {
+	return &IdentityRegistry{Map: make(map[string]mapping)}
+}
+
+func TestAddMappingNeverExpires(t *testing.T) {
+	reg := newTestRegistry()
+	reg.AddMapping("id1", "id2")
+
+	reg.evictExpired(time.Now().Add(365 * 24 * time.Hour))
+	if !reg.Check("id1", "id2") {
+		t.Errorf("Check(id1, id2) = false, want true: a zero-TTL mapping must never expire")
+	}
+}
+
+func TestAddMappingWithTTLExpiresLazily(t *testing.T) {
+	reg := newTestRegistry()
+	reg.AddMappingWithTTL("id1", "id2", 10*time.Millisecond)
+
+	if !reg.Check("id1", "id2") {
+		t.Fatalf("Check(id1, id2) = false immediately after AddMappingWithTTL, want true")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	// No eviction loop is running in this test; Check must still treat the
+	// mapping as gone on its own (lazy expiry), since a stopped or delayed
+	// eviction goroutine must never cause an expired mapping to be honored.
+	if reg.Check("id1", "id2") {
+		t.Errorf("Check(id1, id2) = true after the TTL elapsed with no eviction loop running, want false")
+	}
+}
+
+func TestEvictExpiredRemovesOnlyExpiredEntries(t *testing.T) {
+	reg := newTestRegistry()
+	now := time.Now()
+	reg.Map["expired"] = mapping{target: "t1", expiresAt: now.Add(-time.Minute)}
+	reg.Map["live"] = mapping{target: "t2", expiresAt: now.Add(time.Hour)}
+	reg.Map["forever"] = mapping{target: "t3"}
+
+	reg.evictExpired(now)
+
+	if _, ok := reg.Map["expired"]; ok {
+		t.Errorf("evictExpired left an already-expired entry in place")
+	}
+	if _, ok := reg.Map["live"]; !ok {
+		t.Errorf("evictExpired removed an entry that had not expired yet")
+	}
+	if _, ok := reg.Map["forever"]; !ok {
+		t.Errorf("evictExpired removed a never-expiring (ttl == 0) entry")
+	}
+}
+
+func TestAddMappingWithTTLRenewsOnReobservation(t *testing.T) {
+	reg := newTestRegistry()
+	const ttl = 60 * time.Millisecond
+
+	reg.AddMappingWithTTL("id1", "id2", ttl)
+	time.Sleep(40 * time.Millisecond)
+	// Re-observing id1 (e.g. the Service heartbeat from Controller.reconcile)
+	// must push expiresAt out again rather than leaving the original
+	// deadline in place.
+	reg.AddMappingWithTTL("id1", "id2", ttl)
+	time.Sleep(40 * time.Millisecond)
+
+	if !reg.Check("id1", "id2") {
+		t.Errorf("Check(id1, id2) = false 80ms after a 60ms TTL was renewed at the 40ms mark, want true")
+	}
+}
+
+func TestDeleteMappingClearsRegardlessOfExpiry(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Map["id1"] = mapping{target: "id2", expiresAt: time.Now().Add(-time.Minute)} // already expired
+
+	reg.DeleteMapping("id1", "id2")
+
+	if _, ok := reg.Map["id1"]; ok {
+		t.Errorf("DeleteMapping left an entry behind for an already-expired mapping")
+	}
+}